@@ -0,0 +1,121 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary rtr7-portmap is a CNI plugin that forwards hostPort/containerPort
+// mappings from a CNI runtimeConfig to router7's firewall, by talking to a
+// long-lived netconfig.ForwardingHandles server over a Unix domain socket
+// (rather than manipulating nftables/iptables itself, since it typically
+// runs inside the container's network namespace and has no access to
+// router7's tables). It is wire-compatible with the upstream portmap
+// plugin's runtimeConfig.portMappings, see
+// https://github.com/containernetworking/plugins/tree/master/plugins/meta/portmap.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+// pluginConf is the CNI network configuration rtr7-portmap expects on
+// stdin: the standard CNI fields (notably prevResult, the result of the
+// IPAM/bridge plugin earlier in the chain that allocated the container's
+// address), plus rtr7Socket (the path of the netconfig.ListenForwardingHandles
+// socket to dial) and the portmap plugin's standard
+// runtimeConfig.portMappings.
+type pluginConf struct {
+	types.NetConf
+
+	RTR7Socket    string `json:"rtr7Socket"`
+	RuntimeConfig struct {
+		PortMappings []netconfig.PortMapping `json:"portMappings"`
+	} `json:"runtimeConfig"`
+}
+
+func parseConfig(stdin []byte) (*pluginConf, error) {
+	conf := &pluginConf{}
+	if err := json.Unmarshal(stdin, conf); err != nil {
+		return nil, fmt.Errorf("parsing CNI config: %v", err)
+	}
+	if conf.RTR7Socket == "" {
+		return nil, fmt.Errorf("CNI config missing rtr7Socket")
+	}
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil, fmt.Errorf("parsing prevResult: %v", err)
+	}
+	return conf, nil
+}
+
+// containerAddr returns the IPv4 address the previous plugin in the CNI
+// chain (typically bridge or host-local) allocated to the container, i.e.
+// the address port mappings should actually DNAT to. hostIP in
+// runtimeConfig.portMappings is the optional host-side bind address, not
+// the container's — it must never be used as the DNAT destination.
+func containerAddr(conf *pluginConf) (string, error) {
+	if conf.PrevResult == nil {
+		return "", fmt.Errorf("CNI config missing prevResult; rtr7-portmap must run after a plugin (e.g. bridge) that allocates the container's address")
+	}
+	result, err := current.GetResult(conf.PrevResult)
+	if err != nil {
+		return "", fmt.Errorf("converting prevResult: %v", err)
+	}
+	for _, ipc := range result.IPs {
+		if v4 := ipc.Address.IP.To4(); v4 != nil {
+			return v4.String(), nil
+		}
+	}
+	return "", fmt.Errorf("prevResult contains no IPv4 address")
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	addr, err := containerAddr(conf)
+	if err != nil {
+		return fmt.Errorf("determining container address: %v", err)
+	}
+
+	if err := netconfig.RequestAddForwarding(conf.RTR7Socket, args.ContainerID, addr, conf.RuntimeConfig.PortMappings); err != nil {
+		return fmt.Errorf("requesting port forwardings: %v", err)
+	}
+
+	result := &current.Result{CNIVersion: conf.CNIVersion}
+	return types.PrintResult(result, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	return netconfig.RequestRemoveForwarding(conf.RTR7Socket, args.ContainerID)
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	_, err := parseConfig(args.StdinData)
+	return err
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "rtr7-portmap CNI plugin")
+}
@@ -0,0 +1,277 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package integration_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+// cniConfigTmpl is the subset of a CNI network configuration that
+// cmd/rtr7-portmap cares about: a portmap-compatible runtimeConfig fed to it
+// on stdin, see
+// https://github.com/containernetworking/plugins/tree/master/plugins/meta/portmap.
+const cniConfigTmpl = `
+{
+  "cniVersion": "0.4.0",
+  "name": "rtr7-portmap-test",
+  "type": "rtr7-portmap",
+  "rtr7Socket": %q,
+  "prevResult": {
+    "cniVersion": "0.4.0",
+    "interfaces": [
+      {"name": "eth0", "sandbox": "/var/run/netns/ns3-portmap"}
+    ],
+    "ips": [
+      {"version": "4", "interface": 0, "address": "192.0.2.2/24", "gateway": "192.0.2.1"}
+    ]
+  },
+  "runtimeConfig": {
+    "portMappings": [
+      {"hostPort": 8180, "containerPort": 80, "protocol": "tcp"}
+    ]
+  }
+}
+`
+
+// buildPortmapPlugin builds cmd/rtr7-portmap into dir and returns its path.
+func buildPortmapPlugin(t *testing.T, dir string) string {
+	t.Helper()
+	plugin := filepath.Join(dir, "rtr7-portmap")
+	build := exec.Command("go", "build", "-o", plugin, "github.com/rtr7/router7/cmd/rtr7-portmap")
+	build.Stderr = os.Stderr
+	if err := build.Run(); err != nil {
+		t.Fatalf("building cmd/rtr7-portmap: %v", err)
+	}
+	return plugin
+}
+
+// runPortmapPlugin execs the already-built plugin binary with command and
+// containerID, feeding it cniConfigTmpl pointed at sock. It is called from
+// within the re-exec'd helper process (see below), which already runs
+// inside the target network namespace, so unlike a real CNI runtime it
+// does not need its own "ip netns exec" — only CNI_NETNS_OVERRIDE to tell
+// rtr7-portmap's skel dispatcher that is expected.
+func runPortmapPlugin(t *testing.T, plugin, sock, tmp, command, containerID string) {
+	t.Helper()
+	cmd := exec.Command(plugin)
+	cmd.Env = append(os.Environ(),
+		"CNI_COMMAND="+command,
+		"CNI_CONTAINERID="+containerID,
+		"CNI_NETNS=/proc/self/ns/net",
+		"CNI_IFNAME=eth0",
+		"CNI_ARGS=IgnoreUnknown=1",
+		// rtr7-portmap never enters CNI_NETNS itself (it only talks to
+		// router7's nftables state over a Unix socket, see
+		// cmd/rtr7-portmap), so it is fine for the CNI runtime (this test,
+		// standing in for one) to already be inside it.
+		"CNI_NETNS_OVERRIDE=true",
+		"CNI_PATH="+tmp,
+	)
+	cmd.Stdin = bytes.NewBufferString(fmt.Sprintf(cniConfigTmpl, sock))
+	cmd.Stderr = os.Stderr
+	if _, err := cmd.Output(); err != nil {
+		t.Fatalf("%v: %v", cmd.Args, err)
+	}
+}
+
+// TestPortmapCNIPlugin builds cmd/rtr7-portmap and drives it through the CNI
+// ADD/DEL protocol against a live netconfig.AddForwarding/RemoveForwarding
+// socket, verifying that the DNAT rule it installs appears and disappears
+// from the ruleset exactly as a CNI runtime (e.g. containerd or Docker)
+// would observe it. The ForwardingHandles server and the plugin invocations
+// both run inside a dedicated network namespace (via the same
+// re-exec-under-"ip netns exec" helper pattern testNetconfigBackend uses),
+// since the DNAT rules they install via nftables.Conn are scoped to
+// whichever namespace the calling process (goroutine, really) is in.
+func TestPortmapCNIPlugin(t *testing.T) {
+	const ns = "ns3-portmap"
+	if os.Getenv("HELPER_PROCESS") == "1" {
+		testPortmapCNIPluginHelper(t)
+		return
+	}
+
+	tmp, err := ioutil.TempDir("", "rtr7-portmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	buildPortmapPlugin(t, tmp)
+
+	add := exec.Command("ip", "netns", "add", ns)
+	add.Stderr = os.Stderr
+	if err := add.Run(); err != nil {
+		t.Fatalf("%v: %v", add.Args, err)
+	}
+	defer exec.Command("ip", "netns", "delete", ns).Run()
+
+	cmd := exec.Command("ip", "netns", "exec", ns, os.Args[0], "-test.run=^TestPortmapCNIPlugin$")
+	cmd.Env = append(os.Environ(), "HELPER_PROCESS=1", "PORTMAP_TMP="+tmp)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testPortmapCNIPluginHelper(t *testing.T) {
+	tmp := os.Getenv("PORTMAP_TMP")
+	plugin := filepath.Join(tmp, "rtr7-portmap")
+	sock := filepath.Join(tmp, "rtr7-portmap.sock")
+
+	handles := netconfig.NewForwardingHandles()
+	srv, err := netconfig.ListenForwardingHandles(sock, handles)
+	if err != nil {
+		t.Fatalf("netconfig.ListenForwardingHandles: %v", err)
+	}
+	defer srv.Close()
+
+	runPortmapPlugin(t, plugin, sock, tmp, "ADD", "container1")
+
+	ruleset, err := netconfig.DumpRuleset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasDNATRule(ruleset, "80", "8180", "192.0.2.2") {
+		t.Fatalf("DNAT rule for container1 not found in ruleset: %+v", ruleset)
+	}
+
+	runPortmapPlugin(t, plugin, sock, tmp, "DEL", "container1")
+
+	ruleset, err = netconfig.DumpRuleset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasDNATRule(ruleset, "80", "8180", "192.0.2.2") {
+		t.Fatalf("DNAT rule for container1 still present after DEL: %+v", ruleset)
+	}
+}
+
+// TestPortmapSurvivesApply verifies that a CNI port forwarding installed by
+// rtr7-portmap survives a subsequent netconfig.Apply reload: Apply's
+// idempotent rebuild flushes every rule in the nat table, the cni-dnat
+// chain's included (it lives in that same table), so Apply must re-inject
+// still-registered forwardings via the ForwardingHandles it was given
+// rather than silently dropping them. Like TestPortmapCNIPlugin, the
+// ForwardingHandles server and the Apply call itself run inside a dedicated
+// network namespace via the re-exec helper pattern.
+func TestPortmapSurvivesApply(t *testing.T) {
+	const ns = "ns3-portmap-reload"
+	if os.Getenv("HELPER_PROCESS") == "1" {
+		testPortmapSurvivesApplyHelper(t)
+		return
+	}
+
+	tmp, err := ioutil.TempDir("", "rtr7-portmap-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	buildPortmapPlugin(t, tmp)
+
+	add := exec.Command("ip", "netns", "add", ns)
+	add.Stderr = os.Stderr
+	if err := add.Run(); err != nil {
+		t.Fatalf("%v: %v", add.Args, err)
+	}
+	defer exec.Command("ip", "netns", "delete", ns).Run()
+
+	cmd := exec.Command("ip", "netns", "exec", ns, os.Args[0], "-test.run=^TestPortmapSurvivesApply$")
+	cmd.Env = append(os.Environ(), "HELPER_PROCESS=1", "PORTMAP_TMP="+tmp)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testPortmapSurvivesApplyHelper(t *testing.T) {
+	tmp := os.Getenv("PORTMAP_TMP")
+	plugin := filepath.Join(tmp, "rtr7-portmap")
+	sock := filepath.Join(tmp, "rtr7-portmap.sock")
+
+	handles := netconfig.NewForwardingHandles()
+	srv, err := netconfig.ListenForwardingHandles(sock, handles)
+	if err != nil {
+		t.Fatalf("netconfig.ListenForwardingHandles: %v", err)
+	}
+	defer srv.Close()
+
+	runPortmapPlugin(t, plugin, sock, tmp, "ADD", "container1")
+
+	ruleset, err := netconfig.DumpRuleset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasDNATRule(ruleset, "80", "8180", "192.0.2.2") {
+		t.Fatalf("DNAT rule for container1 not found in ruleset before reload: %+v", ruleset)
+	}
+
+	// netconfig.Apply runs in this same (re-exec'd, namespaced) process as
+	// ListenForwardingHandles above, just like the running router7 daemon
+	// would host both in one process: an empty configuration directory is
+	// enough to exercise the nat table rebuild that would otherwise flush
+	// the cni-dnat chain's rules.
+	if err := netconfig.Apply(tmp, tmp, handles); err != nil {
+		t.Fatalf("netconfig.Apply: %v", err)
+	}
+
+	ruleset, err = netconfig.DumpRuleset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasDNATRule(ruleset, "80", "8180", "192.0.2.2") {
+		t.Fatalf("DNAT rule for container1 did not survive netconfig.Apply: %+v", ruleset)
+	}
+}
+
+// hasDNATRule reports whether ruleset contains a DNAT rule forwarding
+// hostPort to containerAddr:containerPort, i.e. the rule cmd/rtr7-portmap is
+// expected to install for a CNI portMappings entry {hostPort, containerPort}
+// against a container whose prevResult allocated it containerAddr.
+func hasDNATRule(ruleset *netconfig.Ruleset, containerPort, hostPort, containerAddr string) bool {
+	for _, table := range ruleset.Tables {
+		for _, chain := range table.Chains {
+			for _, rule := range chain.Rules {
+				var matchesDport, dnatsToContainer bool
+				for _, expr := range rule.Expressions {
+					switch e := expr.(type) {
+					case netconfig.MatchPayload:
+						if e.Field == "dport" && e.Value == hostPort {
+							matchesDport = true
+						}
+					case netconfig.NAT:
+						if e.Type == netconfig.NATTypeDNAT && e.Port == containerPort && e.Addr == containerAddr {
+							dnatsToContainer = true
+						}
+					}
+				}
+				if matchesDport && dnatsToContainer {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package netconfig applies router7's network configuration (interfaces,
+// addresses, routes, DNS and firewall rules) to the running kernel.
+package netconfig
+
+// Interface describes one network interface to be configured, matched to an
+// existing kernel link by its (factory) hardware address.
+type Interface struct {
+	HardwareAddr      string `json:"hardware_addr"`
+	SpoofHardwareAddr string `json:"spoof_hardware_addr,omitempty"`
+	Name              string `json:"name"`
+	Addr              string `json:"addr,omitempty"`
+}
+
+// InterfaceConfig is the top-level schema of interfaces.json.
+type InterfaceConfig struct {
+	Interfaces []Interface `json:"interfaces"`
+}
+
+// PortForwarding describes one port forwarding rule, as configured via
+// portforwardings.json. AllowCountries/DenyCountries, if set, additionally
+// restrict the rule to (or exclude it from) connections originating from an
+// IP geolocated in one of the given ISO 3166-1 alpha-2 countries, resolved
+// via GeoIPConfig’s MMDB.
+type PortForwarding struct {
+	Proto          string   `json:"proto,omitempty"` // defaults to tcp
+	Port           string   `json:"port"`
+	DestAddr       string   `json:"dest_addr"`
+	DestPort       string   `json:"dest_port"`
+	AllowCountries []string `json:"allow_countries,omitempty"`
+	DenyCountries  []string `json:"deny_countries,omitempty"`
+}
+
+// PortForwardingConfig is the top-level schema of portforwardings.json.
+type PortForwardingConfig struct {
+	Forwardings []PortForwarding `json:"forwardings"`
+}
+
+func (p PortForwarding) proto() string {
+	if p.Proto == "" {
+		return "tcp"
+	}
+	return p.Proto
+}
+
+// geoCountries returns the country codes fwd's AllowCountries or
+// DenyCountries (whichever is set) references, and whether the resulting
+// nftables set match needs to be inverted (true for DenyCountries). It
+// returns a nil slice if neither field is set.
+func (p PortForwarding) geoCountries() (countries []string, invert bool) {
+	if len(p.DenyCountries) > 0 {
+		return p.DenyCountries, true
+	}
+	return p.AllowCountries, false
+}
+
+// GeoIPConfig is the top-level schema of geoip.json: the MaxMind
+// GeoLite2-Country (or compatible) database to resolve AllowCountries and
+// DenyCountries against, and the countries Apply needs to precompute CIDR
+// sets for. BlockCountries, if set, additionally scopes a standing
+// forward-chain drop rule: traffic from an IP geolocated in one of these
+// countries is dropped regardless of which port forwarding (if any) it
+// would otherwise have matched.
+type GeoIPConfig struct {
+	MMDBPath       string   `json:"mmdb_path"`
+	Countries      []string `json:"countries"`
+	BlockCountries []string `json:"block_countries,omitempty"`
+}
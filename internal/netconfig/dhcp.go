@@ -0,0 +1,154 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// dhcp4Lease mirrors the wire/lease.json written by the dhcp4 service.
+type dhcp4Lease struct {
+	ValidUntil time.Time `json:"valid_until"`
+	ClientIP   string    `json:"client_ip"`
+	SubnetMask string    `json:"subnet_mask"`
+	Router     string    `json:"router"`
+	DNS        []string  `json:"dns"`
+}
+
+// dhcp6Prefix mirrors one delegated prefix from a dhcp6 lease.
+type dhcp6Prefix struct {
+	IP   net.IP
+	Mask net.IPMask
+}
+
+// dhcp6Lease mirrors the wire/lease.json written by the dhcp6 service.
+type dhcp6Lease struct {
+	ValidUntil time.Time     `json:"valid_until"`
+	Prefixes   []dhcp6Prefix `json:"prefixes"`
+	DNS        []string      `json:"dns"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Unlike the default []byte
+// handling for net.IP (which would base64-decode it), the wire format
+// stores IP as its textual representation and only Mask as base64.
+func (p *dhcp6Prefix) UnmarshalJSON(b []byte) error {
+	var aux struct {
+		IP   string
+		Mask net.IPMask
+	}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	p.IP = net.ParseIP(aux.IP)
+	p.Mask = aux.Mask
+	return nil
+}
+
+func readJSON(path string, v interface{}) (bool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return true, nil
+}
+
+// applyDHCP4 configures uplink’s address and routes from the dhcp4 lease
+// found in dir. It does nothing if no lease was found.
+func applyDHCP4(dir string, uplink netlink.Link) error {
+	var lease dhcp4Lease
+	ok, err := readJSON(filepath.Join(dir, "dhcp4", "wire", "lease.json"), &lease)
+	if err != nil || !ok {
+		return err
+	}
+
+	ones, _ := net.IPMask(net.ParseIP(lease.SubnetMask).To4()).Size()
+	addr := &netlink.Addr{IPNet: &net.IPNet{
+		IP:   net.ParseIP(lease.ClientIP).To4(),
+		Mask: net.CIDRMask(ones, 32),
+	}}
+	if err := replaceAddr(uplink, addr); err != nil {
+		return err
+	}
+
+	router := net.ParseIP(lease.Router).To4()
+	routes := []*netlink.Route{
+		{
+			LinkIndex: uplink.Attrs().Index,
+			Dst:       &net.IPNet{IP: router, Mask: net.CIDRMask(32, 32)},
+			Scope:     netlink.SCOPE_LINK,
+			Protocol:  netlink.RouteProtocol(unix.RTPROT_DHCP),
+			Src:       net.ParseIP(lease.ClientIP).To4(),
+		},
+		{
+			LinkIndex: uplink.Attrs().Index,
+			Gw:        router,
+			Protocol:  netlink.RouteProtocol(unix.RTPROT_DHCP),
+			Src:       net.ParseIP(lease.ClientIP).To4(),
+		},
+	}
+	for _, r := range routes {
+		if err := netlink.RouteReplace(r); err != nil {
+			return fmt.Errorf("adding route %v: %v", r, err)
+		}
+	}
+	return nil
+}
+
+// applyDHCP6 assigns the LAN-facing interface (lan) the ::1 host address
+// within the first prefix delegated in the dhcp6 lease found in dir.
+func applyDHCP6(dir string, lan netlink.Link) error {
+	var lease dhcp6Lease
+	ok, err := readJSON(filepath.Join(dir, "dhcp6", "wire", "lease.json"), &lease)
+	if err != nil || !ok || len(lease.Prefixes) == 0 {
+		return err
+	}
+	prefix := lease.Prefixes[0]
+	ones, _ := prefix.Mask.Size()
+	host := make(net.IP, len(prefix.IP))
+	copy(host, prefix.IP)
+	host[len(host)-1] |= 1 // ::1
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: host, Mask: net.CIDRMask(ones, 128)}}
+	return replaceAddr(lan, addr)
+}
+
+func replaceAddr(link netlink.Link, addr *netlink.Addr) error {
+	existing, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	for _, e := range existing {
+		if e.IPNet.String() == addr.IPNet.String() {
+			return nil
+		}
+	}
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		return fmt.Errorf("assigning %v to %s: %v", addr, link.Attrs().Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Possible FirewallBackend names, as returned by selectBackend and
+// accepted by ForceBackend.
+const (
+	BackendNFTables = "nftables"
+	BackendIPTables = "iptables"
+)
+
+// ForceBackend, if non-empty, overrides the automatic FirewallBackend
+// selection that would otherwise be based on kernel nftables support. Tests
+// use this to exercise both backends regardless of the kernel they run
+// under; production code leaves it unset.
+var ForceBackend string
+
+// FirewallBackend applies router7's firewall rules (port forwardings, the
+// uplink MASQUERADE rule, the forward chain's TCP MSS clamp and, if
+// blockCountries is non-empty, a forward-chain drop rule scoped to it)
+// using a particular kernel packet filtering API. sets holds the
+// precomputed GeoIP CIDR prefixes (see loadGeoSets) that
+// AllowCountries/DenyCountries/BlockCountries reference; the iptables
+// backend does not support GeoIP scoping and rejects both instead of
+// silently ignoring them.
+type FirewallBackend interface {
+	Apply(forwardings []PortForwarding, sets geoSets, blockCountries []string) error
+}
+
+type nftablesBackend struct{}
+
+func (nftablesBackend) Apply(forwardings []PortForwarding, sets geoSets, blockCountries []string) error {
+	return applyFirewallNFTables(forwardings, sets, blockCountries)
+}
+
+type iptablesBackend struct{}
+
+func (iptablesBackend) Apply(forwardings []PortForwarding, sets geoSets, blockCountries []string) error {
+	for _, fwd := range forwardings {
+		if countries, _ := fwd.geoCountries(); len(countries) > 0 {
+			return fmt.Errorf("port forwarding %s/%s: GeoIP scoping (allow_countries/deny_countries) is not supported by the iptables backend", fwd.proto(), fwd.Port)
+		}
+	}
+	if len(blockCountries) > 0 {
+		return fmt.Errorf("block_countries: GeoIP scoping is not supported by the iptables backend")
+	}
+	return applyFirewallIPTables(forwardings)
+}
+
+// applyFirewallBackend applies forwardings using the selected
+// FirewallBackend, falling back from nftables to iptables if the running
+// kernel rejects nftables netlink requests with EOPNOTSUPP (e.g. a kernel
+// built without CONFIG_NF_TABLES). It returns the backend that was actually
+// used (BackendNFTables or BackendIPTables), which can differ from
+// selectBackend()'s answer precisely in that fallback case — callers that
+// need to know which backend ends up governing the nat table (e.g. Apply,
+// deciding whether to run ForwardingHandles.Reapply) must use this return
+// value instead of calling selectBackend() again.
+func applyFirewallBackend(forwardings []PortForwarding, sets geoSets, blockCountries []string) (string, error) {
+	backend := selectBackend()
+	if backend == BackendNFTables {
+		if err := (nftablesBackend{}).Apply(forwardings, sets, blockCountries); err == nil || !errors.Is(err, unix.EOPNOTSUPP) {
+			return BackendNFTables, err
+		}
+		backend = BackendIPTables
+	}
+	return backend, iptablesBackend{}.Apply(forwardings, sets, blockCountries)
+}
+
+// selectBackend returns ForceBackend if set, or probes the running kernel
+// for nftables support (the presence of /proc/net/nf_tables) otherwise.
+func selectBackend() string {
+	if ForceBackend != "" {
+		return ForceBackend
+	}
+	if _, err := os.Stat("/proc/net/nf_tables"); err != nil {
+		return BackendIPTables
+	}
+	return BackendNFTables
+}
@@ -0,0 +1,81 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// applyFirewallIPTables installs the same DNAT/MASQUERADE/TCPMSS-clamp
+// rules as applyFirewallNFTables, but via iptables(8)/ip6tables(8), for
+// kernels too old or too stripped-down to support nftables. Each chain is
+// flushed before being repopulated, making repeated calls idempotent.
+//
+// It does not support AllowCountries/DenyCountries (iptables has no
+// equivalent to an nftables named set without introducing an ipset
+// dependency): rather than silently installing an unscoped rule, it is the
+// caller's (iptablesBackend.Apply's) job to reject such a forwarding before
+// calling this function.
+func applyFirewallIPTables(forwardings []PortForwarding) error {
+	for _, cmd := range [][]string{
+		{"iptables", "-t", "nat", "-F", "PREROUTING"},
+		{"iptables", "-t", "nat", "-F", "POSTROUTING"},
+	} {
+		if err := iptablesRun(cmd...); err != nil {
+			return err
+		}
+	}
+
+	for _, fwd := range sortedForwardings(forwardings) {
+		dest := fwd.DestAddr + ":" + fwd.DestPort
+		if err := iptablesRun("iptables", "-t", "nat", "-A", "PREROUTING",
+			"-i", "uplink0",
+			"-p", fwd.proto(),
+			"--dport", strings.Replace(fwd.Port, "-", ":", 1), // iptables spells port ranges lo:hi
+			"-j", "DNAT", "--to-destination", dest); err != nil {
+			return err
+		}
+	}
+
+	if err := iptablesRun("iptables", "-t", "nat", "-A", "POSTROUTING",
+		"-o", "uplink0", "-j", "MASQUERADE"); err != nil {
+		return err
+	}
+
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		if err := iptablesRun(bin, "-t", "filter", "-F", "FORWARD"); err != nil {
+			return err
+		}
+		if err := iptablesRun(bin, "-t", "filter", "-A", "FORWARD",
+			"-o", "uplink0",
+			"-p", "tcp", "--tcp-flags", "SYN,RST", "SYN",
+			"-j", "TCPMSS", "--clamp-mss-to-pmtu"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func iptablesRun(args ...string) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %v: %s", cmd.Args, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,374 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/google/nftables"
+)
+
+// forwardingTable and forwardingChain hold the DNAT rules created by
+// AddForwarding, in a base chain separate from the one Apply manages so
+// that a CNI runtime adding/removing per-container port forwardings never
+// races with the next netconfig.Apply reload. Apply's idempotent rebuild
+// still flushes every rule in the (shared) nat table, cni-dnat included;
+// ForwardingHandles.Reapply is how its rules survive that, by re-installing
+// themselves once Apply is done (see netconfig.Apply).
+const (
+	forwardingTable = "nat"
+	forwardingChain = "cni-dnat"
+)
+
+// PortMapping describes one CNI portmap-compatible port mapping, as found
+// in a CNI network configuration's runtimeConfig.portMappings (see
+// https://github.com/containernetworking/plugins/tree/master/plugins/meta/portmap).
+type PortMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol,omitempty"` // defaults to tcp
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+func (m PortMapping) proto() string {
+	if m.Protocol == "" {
+		return "tcp"
+	}
+	return m.Protocol
+}
+
+// ForwardingHandles is a persistent table of the nftables rule handles
+// materialized for each CNI container's port mappings, so that
+// RemoveForwarding can delete exactly (and only) the rules belonging to
+// that container. It also remembers the mappings themselves (and the
+// container address they DNAT to), so that Reapply can recreate the rules
+// (and their now-stale handles) after netconfig.Apply flushes the cni-dnat
+// chain along with the rest of the nat table.
+type ForwardingHandles struct {
+	mu          sync.Mutex
+	forwardings map[string]containerForwarding
+	byContainer map[string][]ruleHandle
+}
+
+// containerForwarding is what AddForwarding(containerID, …) recorded: the
+// container's address (read from the CNI chain's prevResult by
+// cmd/rtr7-portmap, since portMappings.hostIP is only the optional
+// host-side bind address) and the port mappings to DNAT to it.
+type containerForwarding struct {
+	Addr     string
+	Mappings []PortMapping
+}
+
+type ruleHandle struct {
+	table  *nftables.Table
+	chain  *nftables.Chain
+	handle uint64
+}
+
+// NewForwardingHandles returns an empty handle table.
+func NewForwardingHandles() *ForwardingHandles {
+	return &ForwardingHandles{
+		forwardings: make(map[string]containerForwarding),
+		byContainer: make(map[string][]ruleHandle),
+	}
+}
+
+// AddForwarding installs a DNAT-to-addr rule for each of mappings, tagged as
+// belonging to containerID, and records the resulting rule handles (and the
+// address/mappings themselves, for Reapply) so that
+// RemoveForwarding(containerID) can undo exactly this call.
+func (h *ForwardingHandles) AddForwarding(containerID, addr string, mappings []PortMapping) error {
+	handles, err := installForwarding(containerID, addr, mappings)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fwd := h.forwardings[containerID]
+	fwd.Addr = addr
+	fwd.Mappings = append(fwd.Mappings, mappings...)
+	h.forwardings[containerID] = fwd
+	h.byContainer[containerID] = append(h.byContainer[containerID], handles...)
+	return nil
+}
+
+// installForwarding installs a DNAT-to-addr rule for each of mappings into
+// the cni-dnat chain on behalf of containerID and returns the resulting rule
+// handles, without recording any of it in a ForwardingHandles — the
+// bookkeeping AddForwarding and Reapply each need around this differs just
+// enough (append vs. replace) that they do it themselves.
+func installForwarding(containerID, addr string, mappings []PortMapping) ([]ruleHandle, error) {
+	conn := &nftables.Conn{}
+	table := conn.AddTable(&nftables.Table{Name: forwardingTable, Family: nftables.TableFamilyIPv4})
+	chain := conn.AddChain(&nftables.Chain{
+		Name:     forwardingChain,
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityRef(-50), // before Apply’s own prerouting chain
+		Policy:   policyRef(nftables.ChainPolicyAccept),
+	})
+
+	var tags [][]byte
+	for _, m := range mappings {
+		exprs := []Expression{
+			MatchMeta{Key: "iifname", Value: "uplink0"},
+			MatchPayload{Proto: m.proto(), Field: "dport", Value: strconv.Itoa(m.HostPort)},
+			NAT{Type: NATTypeDNAT, Addr: addr, Port: strconv.Itoa(m.ContainerPort)},
+		}
+		userData := marshalUserData(exprs)
+		conn.AddRule(&nftables.Rule{
+			Table:    table,
+			Chain:    chain,
+			Exprs:    toNFTExprs(nftables.TableFamilyIPv4, exprs),
+			UserData: userData,
+		})
+		tags = append(tags, userData)
+	}
+
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("installing forwardings for %s: %v", containerID, err)
+	}
+
+	rules, err := conn.GetRules(table, chain)
+	if err != nil {
+		return nil, fmt.Errorf("reading back forwardings for %s: %v", containerID, err)
+	}
+
+	var handles []ruleHandle
+	for _, tag := range tags {
+		for _, r := range rules {
+			if bytes.Equal(r.UserData, tag) {
+				handles = append(handles, ruleHandle{table: table, chain: chain, handle: r.Handle})
+				break
+			}
+		}
+	}
+	return handles, nil
+}
+
+// RemoveForwarding deletes the rules previously installed by
+// AddForwarding(containerID, …). It is a no-op if containerID has no
+// forwardings (e.g. because the CNI runtime calls DEL twice, or because
+// Invalidate ran concurrently and already discarded the handles — see
+// Invalidate's doc comment).
+func (h *ForwardingHandles) RemoveForwarding(containerID string) error {
+	h.mu.Lock()
+	handles := h.byContainer[containerID]
+	delete(h.byContainer, containerID)
+	delete(h.forwardings, containerID)
+	h.mu.Unlock()
+
+	if len(handles) == 0 {
+		return nil
+	}
+
+	conn := &nftables.Conn{}
+	for _, hdl := range handles {
+		if err := conn.DelRule(&nftables.Rule{Table: hdl.table, Chain: hdl.chain, Handle: hdl.handle}); err != nil {
+			return fmt.Errorf("removing forwarding for %s: %v", containerID, err)
+		}
+	}
+	return conn.Flush()
+}
+
+// Invalidate discards every recorded rule handle (but not the underlying
+// forwardings themselves, which Reapply still needs). netconfig.Apply calls
+// this right before it flushes the nat table, closing the race where a
+// concurrent RemoveForwarding(id) would otherwise read handles that are
+// about to become (or already are) stale — for a rule the kernel has
+// flushed out from under it, RemoveForwarding must not attempt a DelRule,
+// since the rule, and any handle identifying it, no longer exist. Seeing no
+// handles for id makes RemoveForwarding correctly treat the removal as
+// already done.
+func (h *ForwardingHandles) Invalidate() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.byContainer = make(map[string][]ruleHandle, len(h.byContainer))
+}
+
+// Reapply re-installs every container's forwardings under fresh rule
+// handles. netconfig.Apply calls this once it has rebuilt the nat table's
+// own chains, since that rebuild flushes the cni-dnat chain's rules too (it
+// lives in the same table) — without this, a long-lived CNI port
+// forwarding would silently disappear on the next Apply/reload instead of
+// surviving it. Apply calls Invalidate before the flush so that a
+// RemoveForwarding racing anywhere between the flush and this call's own
+// per-container loop sees no stale handles (see Invalidate).
+//
+// A RemoveForwarding(id) for a container being reapplied can also run
+// concurrently with this loop itself (the CNI runtime tearing it down while
+// Apply reloads); if that happens, the just-installed rules are deleted
+// again instead of being recorded, so neither a stale h.byContainer entry
+// nor an orphaned DNAT rule survives past this call.
+func (h *ForwardingHandles) Reapply() error {
+	h.mu.Lock()
+	containers := make(map[string]containerForwarding, len(h.forwardings))
+	for id, fwd := range h.forwardings {
+		containers[id] = containerForwarding{Addr: fwd.Addr, Mappings: append([]PortMapping(nil), fwd.Mappings...)}
+	}
+	h.mu.Unlock()
+
+	for id, fwd := range containers {
+		handles, err := installForwarding(id, fwd.Addr, fwd.Mappings)
+		if err != nil {
+			return fmt.Errorf("reapplying forwardings for %s: %v", id, err)
+		}
+
+		h.mu.Lock()
+		_, stillPresent := h.forwardings[id]
+		if stillPresent {
+			h.byContainer[id] = handles
+		}
+		h.mu.Unlock()
+
+		if !stillPresent {
+			conn := &nftables.Conn{}
+			for _, hdl := range handles {
+				conn.DelRule(&nftables.Rule{Table: hdl.table, Chain: hdl.chain, Handle: hdl.handle})
+			}
+			if err := conn.Flush(); err != nil {
+				return fmt.Errorf("removing forwardings reapplied for since-removed container %s: %v", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// forwardingRequest/forwardingResponse are the wire format ListenForwardingHandles
+// speaks with cmd/rtr7-portmap over the Unix socket: one JSON request,
+// answered with one JSON response, per connection.
+type forwardingRequest struct {
+	Command     string        `json:"command"` // "ADD" or "REMOVE"
+	ContainerID string        `json:"container_id"`
+	Addr        string        `json:"addr,omitempty"`
+	Mappings    []PortMapping `json:"mappings,omitempty"`
+}
+
+type forwardingResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+// ForwardingServer accepts connections on the socket ListenForwardingHandles
+// was given, applying each request to the ForwardingHandles it was
+// constructed with.
+type ForwardingServer struct {
+	ln net.Listener
+}
+
+// Close stops accepting new connections.
+func (s *ForwardingServer) Close() error {
+	return s.ln.Close()
+}
+
+// ListenForwardingHandles starts serving AddForwarding/RemoveForwarding
+// requests from cmd/rtr7-portmap (or any other CNI plugin speaking the same
+// protocol) on a Unix domain socket at path, applying them to handles.
+func ListenForwardingHandles(path string, handles *ForwardingHandles) (*ForwardingServer, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	srv := &ForwardingServer{ln: ln}
+	go srv.serve(handles)
+	return srv, nil
+}
+
+func (s *ForwardingServer) serve(handles *ForwardingHandles) {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn, handles)
+	}
+}
+
+func (s *ForwardingServer) handle(conn net.Conn, handles *ForwardingHandles) {
+	defer conn.Close()
+	var req forwardingRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(forwardingResponse{Error: err.Error()})
+		return
+	}
+
+	var resp forwardingResponse
+	var err error
+	switch req.Command {
+	case "ADD":
+		err = handles.AddForwarding(req.ContainerID, req.Addr, req.Mappings)
+	case "REMOVE":
+		err = handles.RemoveForwarding(req.ContainerID)
+	default:
+		err = fmt.Errorf("unknown command %q", req.Command)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// RequestAddForwarding dials the ForwardingServer listening on sockPath and
+// asks it to install forwardings DNATing to addr (the container's address,
+// read from the CNI chain's prevResult) on behalf of containerID. It is the
+// client half used by cmd/rtr7-portmap's ADD command.
+func RequestAddForwarding(sockPath, containerID, addr string, mappings []PortMapping) error {
+	return requestForwarding(sockPath, forwardingRequest{
+		Command:     "ADD",
+		ContainerID: containerID,
+		Addr:        addr,
+		Mappings:    mappings,
+	})
+}
+
+// RequestRemoveForwarding is the client half used by cmd/rtr7-portmap's DEL
+// command.
+func RequestRemoveForwarding(sockPath, containerID string) error {
+	return requestForwarding(sockPath, forwardingRequest{
+		Command:     "REMOVE",
+		ContainerID: containerID,
+	})
+}
+
+func requestForwarding(sockPath string, req forwardingRequest) error {
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		return fmt.Errorf("dialing %s: %v", sockPath, err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+
+	var resp forwardingResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("decoding response: %v", err)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	return nil
+}
@@ -0,0 +1,380 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoSets maps an nftables set name (see geoSetName) to the sorted CIDR
+// prefixes it should contain, as precomputed by loadGeoSets from a GeoIP
+// config’s MMDB. IPv4 and IPv6 prefixes for the same country live in
+// separate entries (geo_xx_v4 vs geo_xx_v6), since an nftables interval set
+// is keyed to a single address length.
+type geoSets map[string][]string
+
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// loadGeoSets reads conf.MMDBPath and buckets every network it attributes
+// to one of conf.Countries or conf.BlockCountries into a per-country,
+// per-family entry, keyed by the nftables set name geoSetName produces for
+// that single country and address family. forwardingSet merges these into
+// the (possibly multi-country) set a given PortForwarding, or the
+// forward-chain drop rule, actually references.
+func loadGeoSets(conf *GeoIPConfig) (geoSets, error) {
+	db, err := maxminddb.Open(conf.MMDBPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %v", conf.MMDBPath, err)
+	}
+	defer db.Close()
+
+	wanted := make(map[string]bool, len(conf.Countries)+len(conf.BlockCountries))
+	for _, c := range conf.Countries {
+		wanted[strings.ToUpper(c)] = true
+	}
+	for _, c := range conf.BlockCountries {
+		wanted[strings.ToUpper(c)] = true
+	}
+
+	sets := make(geoSets)
+	networks := db.Networks(maxminddb.SkipAliasedNetworks)
+	for networks.Next() {
+		var rec geoIPRecord
+		subnet, err := networks.Network(&rec)
+		if err != nil {
+			return nil, fmt.Errorf("decoding network: %v", err)
+		}
+		if !wanted[rec.Country.ISOCode] {
+			continue
+		}
+		family := nftables.TableFamilyIPv4
+		if subnet.IP.To4() == nil {
+			family = nftables.TableFamilyIPv6
+		}
+		name := geoSetName([]string{rec.Country.ISOCode}, family)
+		sets[name] = append(sets[name], subnet.String())
+	}
+	if err := networks.Err(); err != nil {
+		return nil, err
+	}
+	for name := range sets {
+		sort.Strings(sets[name])
+	}
+	return sets, nil
+}
+
+// geoSetName derives the nftables set name for a list of country codes and
+// an address family, e.g. geoSetName([]string{"DE"}, nftables.TableFamilyIPv4)
+// == "geo_de_v4" and geoSetName([]string{"DE"}, nftables.TableFamilyIPv6) ==
+// "geo_de_v6".
+func geoSetName(countries []string, family nftables.TableFamily) string {
+	sorted := append([]string(nil), countries...)
+	sort.Strings(sorted)
+	for i, c := range sorted {
+		sorted[i] = strings.ToLower(c)
+	}
+	suffix := "v4"
+	if family == nftables.TableFamilyIPv6 {
+		suffix = "v6"
+	}
+	return "geo_" + strings.Join(sorted, "_") + "_" + suffix
+}
+
+// forwardingSet returns the CIDR prefixes of address family family that a
+// PortForwarding’s AllowCountries or DenyCountries (whichever is
+// non-empty), or blockCountries, references, by unioning the per-country
+// entries of sets.
+func (s geoSets) forwardingSet(countries []string, family nftables.TableFamily) []string {
+	var elements []string
+	for _, c := range countries {
+		elements = append(elements, s[geoSetName([]string{c}, family)]...)
+	}
+	sort.Strings(elements)
+	return elements
+}
+
+// cidrToRange splits cidr into the inclusive start and exclusive end address
+// of an nftables interval set element pair, the representation the kernel
+// expects for `type ipv4_addr; flags interval;`/`type ipv6_addr; flags
+// interval;` sets. It works for both address families: net.ParseCIDR
+// already returns an IP/Mask pair of matching length (4 bytes for a
+// dotted-decimal prefix, 16 for a colon-separated one).
+func cidrToRange(cidr string) (start, end net.IP, err error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, nil, err
+	}
+	start = network.IP
+	end = make(net.IP, len(start))
+	copy(end, start)
+	for i := len(network.Mask) - 1; i >= 0; i-- {
+		end[i] |= ^network.Mask[i]
+	}
+	end = incIP(end)
+	return start, end, nil
+}
+
+// cidrFromRange is the inverse of cidrToRange: given the inclusive start and
+// exclusive end address of an interval set element pair (either 4 or 16
+// bytes long, matching the set's key type), it reconstructs the CIDR
+// prefix, if start/end indeed describe one (which every prefix router7
+// itself creates does).
+func cidrFromRange(start, end net.IP) (string, bool) {
+	if len(start) != len(end) || (len(start) != net.IPv4len && len(start) != net.IPv6len) {
+		return "", false
+	}
+	bits := len(start) * 8
+	last := decIP(end)
+	for prefixLen := bits; prefixLen >= 0; prefixLen-- {
+		mask := net.CIDRMask(prefixLen, bits)
+		network := start.Mask(mask)
+		if !network.Equal(start) {
+			continue
+		}
+		broadcast := make(net.IP, len(network))
+		for i := range network {
+			broadcast[i] = network[i] | ^mask[i]
+		}
+		if broadcast.Equal(last) {
+			return fmt.Sprintf("%s/%d", network, prefixLen), true
+		}
+	}
+	return "", false
+}
+
+// geoSetElements converts cidrs into the interval set elements
+// applyFirewallNFTables installs for a GeoIP set: each prefix becomes two
+// elements, one at the prefix's start address and one — flagged
+// IntervalEnd — at its (exclusive) end address. This is the classic
+// two-element representation for `flags interval;` sets; the newer
+// single-element {Key: start, KeyEnd: end} shorthand nftables.SetElement
+// also supports is rejected by some kernels (observed: "invalid argument"
+// from NFT_MSG_NEWSETELEM), so this package always uses the two-element
+// form, on the add and the decode side alike (see decodeIntervalElements).
+func geoSetElements(cidrs []string) ([]nftables.SetElement, error) {
+	elements := make([]nftables.SetElement, 0, 2*len(cidrs))
+	for _, cidr := range cidrs {
+		start, end, err := cidrToRange(cidr)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, nftables.SetElement{Key: start}, nftables.SetElement{Key: end, IntervalEnd: true})
+	}
+	return elements, nil
+}
+
+// decodeIntervalElements pairs up the flat list of start/end nodes an
+// interval set's Conn.GetSetElements returns — one non-flagged node per
+// range start and one IntervalEnd-flagged node per range end, not
+// necessarily returned in that order — back into the CIDR prefixes
+// geoSetElements originally installed. Starts and ends are sorted and
+// ranked independently rather than paired up by position in a single
+// combined sort: geoSetElements only ever installs disjoint ranges, so the
+// i-th smallest start always belongs with the i-th smallest end, whereas
+// sorting both kinds together breaks ties arbitrarily whenever one CIDR's
+// end address equals the next CIDR's start address (adjacent prefixes,
+// which GeoIP country data produces often), silently dropping both.
+func decodeIntervalElements(elements []nftables.SetElement) []string {
+	var starts, ends []nftables.SetElement
+	for _, e := range elements {
+		if e.IntervalEnd {
+			ends = append(ends, e)
+		} else {
+			starts = append(starts, e)
+		}
+	}
+	if len(starts) != len(ends) {
+		return nil // malformed: not the start/end pairs geoSetElements produced
+	}
+	sort.Slice(starts, func(i, j int) bool { return bytes.Compare(starts[i].Key, starts[j].Key) < 0 })
+	sort.Slice(ends, func(i, j int) bool { return bytes.Compare(ends[i].Key, ends[j].Key) < 0 })
+
+	var cidrs []string
+	for i := range starts {
+		if cidr, ok := cidrFromRange(starts[i].Key, ends[i].Key); ok {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	return cidrs
+}
+
+// RefreshGeoSets reloads conf's MMDB from dir's portforwardings.json and
+// geoip.json and updates every GeoIP nftables set a previous Apply already
+// installed to match, using the set-element transaction nftables exposes
+// (NFT_MSG_NEWSETELEM/NFT_MSG_DELSETELEM via Conn.SetAddElements/
+// SetDeleteElements) instead of Apply's full nat/filter table rebuild. This
+// lets a periodic MMDB refresh (e.g. picking up a new GeoLite2 release) pick
+// up changed country prefixes without flushing the nat/filter tables — and
+// therefore without dropping the connections those tables' rules are
+// currently tracking. It is a no-op for a set no running config references,
+// or that Apply has not created yet; the next full Apply creates those as
+// usual.
+func RefreshGeoSets(dir string) error {
+	var pf PortForwardingConfig
+	if _, err := readJSON(filepath.Join(dir, "portforwardings.json"), &pf); err != nil {
+		return fmt.Errorf("reading portforwardings.json: %v", err)
+	}
+
+	var geo GeoIPConfig
+	ok, err := readJSON(filepath.Join(dir, "geoip.json"), &geo)
+	if err != nil {
+		return fmt.Errorf("reading geoip.json: %v", err)
+	}
+	if !ok {
+		return nil
+	}
+
+	sets, err := loadGeoSets(&geo)
+	if err != nil {
+		return fmt.Errorf("loading geoip database: %v", err)
+	}
+
+	conn := &nftables.Conn{}
+	nat := &nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4}
+
+	refreshed := make(map[string]bool)
+	for _, fwd := range sortedForwardings(pf.Forwardings) {
+		countries, _ := fwd.geoCountries()
+		if len(countries) == 0 {
+			continue
+		}
+		// AllowCountries/DenyCountries only ever scope the IPv4 nat table,
+		// see applyFirewallNFTables.
+		name := geoSetName(countries, nftables.TableFamilyIPv4)
+		if refreshed[name] {
+			continue
+		}
+		if err := refreshGeoSet(conn, nat, name, sets.forwardingSet(countries, nftables.TableFamilyIPv4)); err != nil {
+			return err
+		}
+		refreshed[name] = true
+	}
+
+	if len(geo.BlockCountries) > 0 {
+		for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+			filter := &nftables.Table{Name: "filter", Family: family}
+			name := geoSetName(geo.BlockCountries, family)
+			if err := refreshGeoSet(conn, filter, name, sets.forwardingSet(geo.BlockCountries, family)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return conn.Flush()
+}
+
+// refreshGeoSet brings the nftables set named name in table up to date with
+// wantCIDRs by diffing it against the kernel's current elements and queuing
+// only the additions and removals onto conn's still-open transaction (the
+// caller's eventual conn.Flush() commits every set's diff as a single atomic
+// batch, so a reader of the set never observes a partially-updated one). It
+// is a no-op if table has no set named name yet.
+func refreshGeoSet(conn *nftables.Conn, table *nftables.Table, name string, wantCIDRs []string) error {
+	set, err := conn.GetSetByName(table, name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// Apply hasn't created this set yet (nothing currently
+			// references it, or the backend hasn't run yet); nothing to
+			// refresh.
+			return nil
+		}
+		return fmt.Errorf("looking up geoip set %s: %v", name, err)
+	}
+
+	current, err := conn.GetSetElements(set)
+	if err != nil {
+		return fmt.Errorf("reading elements of geoip set %s: %v", name, err)
+	}
+	haveCIDRs := make(map[string]bool, len(current)/2)
+	for _, cidr := range decodeIntervalElements(current) {
+		haveCIDRs[cidr] = true
+	}
+
+	want := make(map[string]bool, len(wantCIDRs))
+	for _, cidr := range wantCIDRs {
+		want[cidr] = true
+	}
+
+	var addCIDRs, removeCIDRs []string
+	for cidr := range want {
+		if !haveCIDRs[cidr] {
+			addCIDRs = append(addCIDRs, cidr)
+		}
+	}
+	for cidr := range haveCIDRs {
+		if !want[cidr] {
+			removeCIDRs = append(removeCIDRs, cidr)
+		}
+	}
+
+	toAdd, err := geoSetElements(addCIDRs)
+	if err != nil {
+		return fmt.Errorf("building added elements for geoip set %s: %v", name, err)
+	}
+	toRemove, err := geoSetElements(removeCIDRs)
+	if err != nil {
+		return fmt.Errorf("building removed elements for geoip set %s: %v", name, err)
+	}
+
+	if len(toAdd) > 0 {
+		if err := conn.SetAddElements(set, toAdd); err != nil {
+			return fmt.Errorf("adding elements to geoip set %s: %v", name, err)
+		}
+	}
+	if len(toRemove) > 0 {
+		if err := conn.SetDeleteElements(set, toRemove); err != nil {
+			return fmt.Errorf("removing elements from geoip set %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func incIP(ip net.IP) net.IP {
+	out := make(net.IP, len(ip))
+	copy(out, ip)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i]++
+		if out[i] != 0 {
+			break
+		}
+	}
+	return out
+}
+
+func decIP(ip net.IP) net.IP {
+	out := make(net.IP, len(ip))
+	copy(out, ip)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i]--
+		if out[i] != 0xff {
+			break
+		}
+	}
+	return out
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+
+	"github.com/vishvananda/netlink"
+)
+
+// applyInterfaces reads interfaces.json from dir, matches each entry to an
+// existing kernel link by its hardware address, renames it, optionally
+// spoofs its hardware address and assigns its static address. It returns the
+// resulting links keyed by the name given in interfaces.json.
+func applyInterfaces(dir string) (map[string]netlink.Link, error) {
+	var cfg InterfaceConfig
+	if _, err := readJSON(filepath.Join(dir, "interfaces.json"), &cfg); err != nil {
+		return nil, err
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]netlink.Link)
+	for _, iface := range cfg.Interfaces {
+		link, err := linkByHardwareAddr(links, iface.HardwareAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		if link.Attrs().Name != iface.Name {
+			if err := netlink.LinkSetName(link, iface.Name); err != nil {
+				return nil, fmt.Errorf("renaming %s to %s: %v", link.Attrs().Name, iface.Name, err)
+			}
+			link, err = netlink.LinkByName(iface.Name)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if iface.SpoofHardwareAddr != "" {
+			hwaddr, err := net.ParseMAC(iface.SpoofHardwareAddr)
+			if err != nil {
+				return nil, err
+			}
+			if err := netlink.LinkSetHardwareAddr(link, hwaddr); err != nil {
+				return nil, fmt.Errorf("spoofing hardware address of %s: %v", iface.Name, err)
+			}
+		}
+
+		if err := netlink.LinkSetUp(link); err != nil {
+			return nil, fmt.Errorf("bringing up %s: %v", iface.Name, err)
+		}
+
+		if iface.Addr != "" {
+			addr, err := netlink.ParseAddr(iface.Addr)
+			if err != nil {
+				return nil, err
+			}
+			if err := replaceAddr(link, addr); err != nil {
+				return nil, err
+			}
+		}
+
+		result[iface.Name] = link
+	}
+	return result, nil
+}
+
+func linkByHardwareAddr(links []netlink.Link, hwaddr string) (netlink.Link, error) {
+	for _, link := range links {
+		if link.Attrs().HardwareAddr.String() == hwaddr {
+			return link, nil
+		}
+	}
+	return nil, fmt.Errorf("no interface with hardware address %s found", hwaddr)
+}
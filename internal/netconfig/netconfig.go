@@ -0,0 +1,593 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// forwardCounterName is the name of the stateful counter object that tracks
+// forwarded traffic, exposed in DumpRuleset as the "forward" chain's
+// CounterObj.
+const forwardCounterName = "fwded"
+
+func policyRef(p nftables.ChainPolicy) *nftables.ChainPolicy { return &p }
+
+// DefaultCounterObj seeds the packet/byte counters of the forward chain’s
+// "fwded" counter object each time Apply (re-)creates it. Tests use this to
+// verify counters survive, or are reset across, repeated Apply calls; in
+// production it is always the zero value.
+var DefaultCounterObj = &nftables.CounterObj{}
+
+// Apply reads the network configuration files written to dir (by
+// netconfigd’s sibling services: interfaces.json, portforwardings.json,
+// dhcp4/dhcp6 leases, …) and applies them to the running kernel: interface
+// naming/addressing, DHCP-assigned addresses and routes, /tmp/resolv.conf
+// (rooted at rootDir) and firewall rules (via nftables, or iptables as a
+// fallback, see applyFirewallBackend). It is idempotent: calling
+// Apply repeatedly converges the kernel to the same state instead of
+// appending duplicate routes, addresses or rules.
+//
+// handles, if non-nil, is re-applied once the firewall rules have been
+// rebuilt: the nftables backend's idempotent rebuild flushes every rule in
+// the nat table, including the cni-dnat chain's (see forwarding.go), so any
+// live CNI port forwardings need to be re-injected or they would otherwise
+// vanish on the next reload. Pass nil if the caller never hands out a
+// ForwardingHandles (e.g. no CNI integration is configured).
+func Apply(dir, rootDir string, handles *ForwardingHandles) error {
+	links, err := applyInterfaces(dir)
+	if err != nil {
+		return fmt.Errorf("applying interfaces: %v", err)
+	}
+
+	if uplink, ok := links["uplink0"]; ok {
+		if err := applyDHCP4(dir, uplink); err != nil {
+			return fmt.Errorf("applying dhcp4 lease: %v", err)
+		}
+	}
+
+	if lan, ok := links["lan0"]; ok {
+		if err := applyDHCP6(dir, lan); err != nil {
+			return fmt.Errorf("applying dhcp6 lease: %v", err)
+		}
+		if err := writeResolvConf(rootDir, lan); err != nil {
+			return fmt.Errorf("writing resolv.conf: %v", err)
+		}
+	}
+
+	var pf PortForwardingConfig
+	if _, err := readJSON(filepath.Join(dir, "portforwardings.json"), &pf); err != nil {
+		return fmt.Errorf("reading portforwardings.json: %v", err)
+	}
+
+	var sets geoSets
+	var geo GeoIPConfig
+	if ok, err := readJSON(filepath.Join(dir, "geoip.json"), &geo); err != nil {
+		return fmt.Errorf("reading geoip.json: %v", err)
+	} else if ok {
+		if sets, err = loadGeoSets(&geo); err != nil {
+			return fmt.Errorf("loading geoip database: %v", err)
+		}
+	}
+
+	if handles != nil {
+		// The nftables backend, if selected below, flushes the nat table
+		// (and with it the cni-dnat chain's rules) as part of its
+		// idempotent rebuild; invalidate now so a RemoveForwarding racing
+		// anywhere from here until Reapply gets back around to reinstalling
+		// a given container never acts on a handle the kernel has already
+		// discarded (see ForwardingHandles.Invalidate).
+		handles.Invalidate()
+	}
+
+	backend, err := applyFirewallBackend(pf.Forwardings, sets, geo.BlockCountries)
+	if err != nil {
+		return err
+	}
+
+	if handles != nil && backend == BackendNFTables {
+		if err := handles.Reapply(); err != nil {
+			return fmt.Errorf("reapplying CNI port forwardings: %v", err)
+		}
+	}
+	return nil
+}
+
+// writeResolvConf points /tmp/resolv.conf at the router itself: dnsd listens
+// on lan’s address and is the only resolver LAN clients and the router’s own
+// processes should ever need, regardless of which upstream DHCP servers
+// handed out DNS servers of their own.
+func writeResolvConf(rootDir string, lan netlink.Link) error {
+	addrs, err := netlink.AddrList(lan, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("lan0 has no IPv4 address")
+	}
+	content := fmt.Sprintf("nameserver %s\n", addrs[0].IP)
+	return os.WriteFile(filepath.Join(rootDir, "tmp", "resolv.conf"), []byte(content), 0644)
+}
+
+// applyFirewallNFTables (re-)creates the nat and filter tables via
+// NFNETLINK: DNAT rules for each configured port forwarding, a MASQUERADE
+// rule for outgoing uplink0 traffic, and a forward chain that clamps the
+// TCP MSS to the path MTU. Tables are created if absent and every rule they
+// contain is flushed before being rebuilt, so that stale rules from a
+// previous Apply never linger and repeated calls converge instead of
+// appending duplicates. Flushing the nat table also empties the cni-dnat
+// chain AddForwarding installs into (see forwarding.go); Apply re-injects
+// those via ForwardingHandles.Reapply once this function returns. sets
+// holds the precomputed per-country CIDR prefixes (see loadGeoSets) that
+// AllowCountries/DenyCountries-scoped forwardings and blockCountries
+// reference. AllowCountries/DenyCountries scoping only ever applies to the
+// IPv4 nat table, since that is the only family a DNAT destination can
+// name; blockCountries, if non-empty, additionally installs a forward-chain
+// rule in both the IPv4 and IPv6 filter tables that drops traffic from a
+// source address geolocated in one of these countries, ahead of (and
+// regardless of) any port forwarding it would otherwise have matched.
+func applyFirewallNFTables(forwardings []PortForwarding, sets geoSets, blockCountries []string) error {
+	conn := &nftables.Conn{}
+
+	nat := conn.AddTable(&nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4})
+	conn.FlushTable(nat)
+	prerouting := conn.AddChain(&nftables.Chain{
+		Name:     "prerouting",
+		Table:    nat,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityRef(0),
+		Policy:   policyRef(nftables.ChainPolicyAccept),
+	})
+	postrouting := conn.AddChain(&nftables.Chain{
+		Name:     "postrouting",
+		Table:    nat,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityRef(100),
+		Policy:   policyRef(nftables.ChainPolicyAccept),
+	})
+
+	geoNFTSets := make(map[string]*nftables.Set)
+	for _, fwd := range sortedForwardings(forwardings) {
+		var geo Expression
+		if countries, invert := fwd.geoCountries(); len(countries) > 0 {
+			// The nat table (and hence every DNAT destination a port
+			// forwarding can name) is IPv4 only, so AllowCountries/
+			// DenyCountries scoping only ever needs the IPv4 half of a
+			// country's CIDR prefixes.
+			name := geoSetName(countries, nftables.TableFamilyIPv4)
+			if _, ok := geoNFTSets[name]; !ok {
+				elements, err := geoSetElements(sets.forwardingSet(countries, nftables.TableFamilyIPv4))
+				if err != nil {
+					return fmt.Errorf("building geoip set %s: %v", name, err)
+				}
+				s := &nftables.Set{Table: nat, Name: name, KeyType: nftables.TypeIPAddr, Interval: true}
+				if err := conn.AddSet(s, elements); err != nil {
+					return fmt.Errorf("adding geoip set %s: %v", name, err)
+				}
+				geoNFTSets[name] = s
+			}
+			geo = MatchSet{Name: name, Invert: invert}
+		}
+		exprs := dnatExpressions(fwd, geo)
+		conn.AddRule(&nftables.Rule{
+			Table:    nat,
+			Chain:    prerouting,
+			Exprs:    toNFTExprs(nftables.TableFamilyIPv4, exprs),
+			UserData: marshalUserData(exprs),
+		})
+	}
+
+	masq := []Expression{
+		MatchMeta{Key: "oifname", Value: "uplink0"},
+		NAT{Type: NATTypeMasquerade},
+	}
+	conn.AddRule(&nftables.Rule{
+		Table:    nat,
+		Chain:    postrouting,
+		Exprs:    toNFTExprs(nftables.TableFamilyIPv4, masq),
+		UserData: marshalUserData(masq),
+	})
+
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		filter := conn.AddTable(&nftables.Table{Name: "filter", Family: family})
+		conn.FlushTable(filter)
+		forward := conn.AddChain(&nftables.Chain{
+			Name:     "forward",
+			Table:    filter,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  nftables.ChainHookForward,
+			Priority: nftables.ChainPriorityRef(0),
+			Policy:   policyRef(nftables.ChainPolicyAccept),
+		})
+
+		conn.AddObj(&nftables.CounterObj{
+			Table:   filter,
+			Name:    forwardCounterName,
+			Packets: DefaultCounterObj.Packets,
+			Bytes:   DefaultCounterObj.Bytes,
+		})
+
+		if len(blockCountries) > 0 {
+			name := geoSetName(blockCountries, family)
+			elements, err := geoSetElements(sets.forwardingSet(blockCountries, family))
+			if err != nil {
+				return fmt.Errorf("building geoip set %s: %v", name, err)
+			}
+			keyType := nftables.TypeIPAddr
+			if family == nftables.TableFamilyIPv6 {
+				keyType = nftables.TypeIP6Addr
+			}
+			s := &nftables.Set{Table: filter, Name: name, KeyType: keyType, Interval: true}
+			if err := conn.AddSet(s, elements); err != nil {
+				return fmt.Errorf("adding geoip set %s: %v", name, err)
+			}
+			blockExprs := []Expression{
+				MatchSet{Name: name},
+				Verdict{Type: VerdictTypeDrop},
+			}
+			conn.AddRule(&nftables.Rule{
+				Table:    filter,
+				Chain:    forward,
+				Exprs:    toNFTExprs(family, blockExprs),
+				UserData: marshalUserData(blockExprs),
+			})
+		}
+
+		counterExprs := []Expression{Counter{Name: forwardCounterName}}
+		conn.AddRule(&nftables.Rule{
+			Table:    filter,
+			Chain:    forward,
+			Exprs:    toNFTExprs(family, counterExprs),
+			UserData: marshalUserData(counterExprs),
+		})
+
+		clampExprs := []Expression{
+			MatchMeta{Key: "oifname", Value: "uplink0"},
+			MatchPayload{Proto: "tcp", Field: "flags", Value: "syn"},
+			TCPOptionClampMSS{},
+		}
+		conn.AddRule(&nftables.Rule{
+			Table:    filter,
+			Chain:    forward,
+			Exprs:    toNFTExprs(family, clampExprs),
+			UserData: marshalUserData(clampExprs),
+		})
+	}
+
+	return conn.Flush()
+}
+
+// dnatExpressions returns the Expression sequence for a prerouting DNAT rule
+// matching fwd: an incoming-interface match, a destination port match, an
+// optional GeoIP source-address set match (non-nil for an
+// AllowCountries/DenyCountries-scoped forwarding, see geoCountries) and the
+// DNAT action itself.
+func dnatExpressions(fwd PortForwarding, geo Expression) []Expression {
+	proto := fwd.proto()
+	exprs := []Expression{
+		MatchMeta{Key: "iifname", Value: "uplink0"},
+		MatchPayload{Proto: proto, Field: "dport", Value: portDisplayName(proto, fwd.Port)},
+	}
+	if geo != nil {
+		exprs = append(exprs, geo)
+	}
+	return append(exprs, NAT{Type: NATTypeDNAT, Addr: fwd.DestAddr, Port: fwd.DestPort})
+}
+
+// marshalUserData JSON-encodes exprs, tagging the rule being built so that
+// AddForwarding can recognize its own just-inserted rules (by comparing
+// UserData) when reading the kernel-assigned handles back via GetRules.
+// DumpRuleset decodes the kernel’s own returned expr.Any sequence directly
+// (see decodeExprs) and only consults UserData as a best-effort enrichment
+// for the handful of fields that sequence cannot represent (e.g. the
+// protocol name of a destination-port match).
+func marshalUserData(exprs []Expression) []byte {
+	b, err := json.Marshal(Rule{Expressions: exprs})
+	if err != nil {
+		// Expression implementations only contain JSON-marshalable
+		// fields; this can only happen due to a programming error.
+		panic(err)
+	}
+	return b
+}
+
+// toNFTExprs lowers our Expression tagged union to the expr.Any sequence
+// nftables actually evaluates, registerizing data as needed. Register
+// re-use across expressions within the same rule is intentional: each match
+// expression loads into register 1 and is immediately consumed by the Cmp
+// that follows it.
+func toNFTExprs(family nftables.TableFamily, exprs []Expression) []expr.Any {
+	var out []expr.Any
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case MatchMeta:
+			out = append(out,
+				&expr.Meta{Key: metaKey(e.Key), Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifnameBytes(e.Value)},
+			)
+
+		case MatchPayload:
+			out = append(out, payloadExprs(e)...)
+
+		case NAT:
+			out = append(out, natExprs(family, e)...)
+
+		case MatchSet:
+			srcOffset, srcLen := uint32(12), uint32(4) // IPv4 source address
+			if family == nftables.TableFamilyIPv6 {
+				srcOffset, srcLen = 8, 16 // IPv6 source address
+			}
+			out = append(out,
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: srcOffset, Len: srcLen},
+				&expr.Lookup{SourceRegister: 1, SetName: e.Name, Invert: e.Invert},
+			)
+
+		case Counter:
+			out = append(out, &expr.Counter{})
+
+		case Verdict:
+			out = append(out, &expr.Verdict{Kind: verdictKind(e.Type)})
+
+		case TCPOptionClampMSS:
+			out = append(out,
+				&expr.Exthdr{
+					Op:           expr.ExthdrOpTcpopt,
+					Type:         2, // TCPOPT_MAXSEG
+					Offset:       2,
+					Len:          2,
+					DestRegister: 1,
+				},
+				&expr.Rt{Key: expr.RtTCPMSS, Register: 2},
+				&expr.Exthdr{
+					Op:             expr.ExthdrOpTcpopt,
+					Type:           2, // TCPOPT_MAXSEG
+					Offset:         2,
+					Len:            2,
+					SourceRegister: 2,
+				},
+			)
+		}
+	}
+	return out
+}
+
+func verdictKind(t VerdictType) expr.VerdictKind {
+	switch t {
+	case VerdictTypeAccept:
+		return expr.VerdictAccept
+	case VerdictTypeContinue:
+		return expr.VerdictContinue
+	case VerdictTypeReturn:
+		return expr.VerdictReturn
+	default:
+		return expr.VerdictDrop
+	}
+}
+
+func metaKey(key string) expr.MetaKey {
+	switch key {
+	case "oifname":
+		return expr.MetaKeyOIFNAME
+	default:
+		return expr.MetaKeyIIFNAME
+	}
+}
+
+// ifnameBytes pads name to IFNAMSIZ (16) bytes, as the kernel expects for
+// NFTA_META_IIFNAME/OIFNAME comparisons.
+func ifnameBytes(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name+"\x00")
+	return b
+}
+
+func payloadExprs(m MatchPayload) []expr.Any {
+	load := &expr.Payload{
+		DestRegister: 1,
+		Base:         expr.PayloadBaseTransportHeader,
+		Offset:       2, // destination port
+		Len:          2,
+	}
+	if m.Field == "flags" {
+		// TCP flags occupy the single byte at offset 13 of the TCP
+		// header; SYN is bit 0x02.
+		return []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 13, Len: 1},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 1, Mask: []byte{0x02}, Xor: []byte{0x00}},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0x00}},
+		}
+	}
+	if lo, hi, ok := portRange(m.Value); ok {
+		return []expr.Any{
+			load,
+			&expr.Cmp{Op: expr.CmpOpGte, Register: 1, Data: binaryutil.BigEndian.PutUint16(lo)},
+			&expr.Cmp{Op: expr.CmpOpLte, Register: 1, Data: binaryutil.BigEndian.PutUint16(hi)},
+		}
+	}
+	port, err := strconv.ParseUint(m.Value, 10, 16)
+	if err != nil {
+		port = uint64(lookupPort(m.Proto, m.Value))
+	}
+	return []expr.Any{
+		load,
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(port))},
+	}
+}
+
+func natExprs(family nftables.TableFamily, n NAT) []expr.Any {
+	if n.Type == NATTypeMasquerade {
+		return []expr.Any{&expr.Masq{}}
+	}
+
+	nftFamily := uint32(unix.NFPROTO_IPV4)
+	if family == nftables.TableFamilyIPv6 {
+		nftFamily = unix.NFPROTO_IPV6
+	}
+
+	addr := net.ParseIP(n.Addr)
+	if v4 := addr.To4(); family == nftables.TableFamilyIPv4 && v4 != nil {
+		addr = v4
+	}
+
+	out := []expr.Any{
+		&expr.Immediate{Register: 1, Data: addr},
+	}
+	nat := &expr.NAT{
+		Type:       expr.NATTypeDestNAT,
+		Family:     nftFamily,
+		RegAddrMin: 1,
+		Specified:  true,
+	}
+	if lo, hi, ok := portRange(n.Port); ok {
+		out = append(out,
+			&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(lo)},
+			&expr.Immediate{Register: 3, Data: binaryutil.BigEndian.PutUint16(hi)},
+		)
+		nat.RegProtoMin = 2
+		nat.RegProtoMax = 3
+	} else if n.Port != "" {
+		port, err := strconv.ParseUint(n.Port, 10, 16)
+		if err == nil {
+			out = append(out, &expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(uint16(port))})
+			nat.RegProtoMin = 2
+		}
+	}
+	return append(out, nat)
+}
+
+// sortedForwardings returns forwardings ordered by ascending starting port,
+// so that both FirewallBackend implementations install rules in the same,
+// predictable order.
+func sortedForwardings(forwardings []PortForwarding) []PortForwarding {
+	sorted := make([]PortForwarding, len(forwardings))
+	copy(sorted, forwardings)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return portStart(sorted[i].Port) < portStart(sorted[j].Port)
+	})
+	return sorted
+}
+
+// portStart returns the numeric start of port, which may be a single port
+// ("53") or a range ("8040-8060"), for ordering forwardings by ascending
+// port the same way regardless of which FirewallBackend ends up applying
+// them.
+func portStart(port string) int {
+	if lo, _, ok := portRange(port); ok {
+		return int(lo)
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// portRange splits a "lo-hi" port range as used in portforwardings.json into
+// its two endpoints. ok is false for a single port.
+func portRange(s string) (lo, hi uint16, ok bool) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	l, err1 := strconv.ParseUint(parts[0], 10, 16)
+	h, err2 := strconv.ParseUint(parts[1], 10, 16)
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	return uint16(l), uint16(h), true
+}
+
+var (
+	servicesOnce sync.Once
+	services     map[string]string // "proto/port" -> name, e.g. "tcp/8080" -> "http-alt"
+)
+
+// portDisplayName returns the /etc/services name for proto/port (e.g.
+// "domain" for udp/53, "http-alt" for tcp/8080), matching what `nft list
+// ruleset` shows for well-known ports, or port unchanged if it is a range or
+// has no registered name.
+func portDisplayName(proto, port string) string {
+	if _, _, ok := portRange(port); ok {
+		return port
+	}
+	servicesOnce.Do(loadServices)
+	if name, ok := services[proto+"/"+port]; ok {
+		return name
+	}
+	return port
+}
+
+// lookupPort is the inverse of portDisplayName: it resolves a service name
+// back to its numeric port, for matches whose Value is e.g. "domain".
+func lookupPort(proto, name string) uint16 {
+	if port, err := strconv.ParseUint(name, 10, 16); err == nil {
+		return uint16(port)
+	}
+	if port, err := net.LookupPort(proto, name); err == nil {
+		return uint16(port)
+	}
+	return 0
+}
+
+// loadServices populates services from /etc/services, falling back to the
+// handful of well-known entries router7’s own tests rely on when /etc/services
+// is unavailable (e.g. in a minimal container).
+func loadServices() {
+	services = map[string]string{
+		"udp/53":   "domain",
+		"tcp/53":   "domain",
+		"tcp/8080": "http-alt",
+	}
+	f, err := os.Open("/etc/services")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		name, portProto := fields[0], fields[1]
+		portAndProto := strings.SplitN(portProto, "/", 2)
+		if len(portAndProto) != 2 {
+			continue
+		}
+		key := portAndProto[1] + "/" + portAndProto[0]
+		if _, ok := services[key]; !ok {
+			services[key] = name
+		}
+	}
+}
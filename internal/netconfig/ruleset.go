@@ -0,0 +1,656 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// Family identifies an nftables address family, mirroring the handful of
+// families router7 actually uses (nftables.TableFamilyIPv4/IPv6).
+type Family string
+
+// Possible Family values.
+const (
+	FamilyIP  Family = "ip"
+	FamilyIP6 Family = "ip6"
+)
+
+func (f Family) nftables() nftables.TableFamily {
+	if f == FamilyIP6 {
+		return nftables.TableFamilyIPv6
+	}
+	return nftables.TableFamilyIPv4
+}
+
+// CounterObj is the decoded state of a named nftables counter object (e.g.
+// "counter fwded { packets 23 bytes 42 }").
+type CounterObj struct {
+	Name    string `json:"name,omitempty"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// Ruleset is the structured, decoded equivalent of the ruleset `nft list
+// ruleset` would print, as produced by DumpRuleset.
+type Ruleset struct {
+	Tables []Table `json:"tables"`
+}
+
+// Table is one nftables table, e.g. "table ip nat".
+type Table struct {
+	Name   string  `json:"name"`
+	Family Family  `json:"family"`
+	Chains []Chain `json:"chains,omitempty"`
+	Sets   []Set   `json:"sets,omitempty"`
+}
+
+// Set is a named nftables set, e.g. the "geo_de_v4" set of CIDR prefixes
+// GeoIP-scoped port forwardings reference via MatchSet.
+type Set struct {
+	Name     string   `json:"name"`
+	Elements []string `json:"elements,omitempty"`
+}
+
+// Chain is one nftables base chain, e.g. "chain prerouting" within the nat
+// table.
+type Chain struct {
+	Name     string       `json:"name"`
+	Hook     string       `json:"hook,omitempty"`
+	Priority int          `json:"priority,omitempty"`
+	Policy   string       `json:"policy,omitempty"`
+	Counters []CounterObj `json:"counters,omitempty"`
+	Rules    []Rule       `json:"rules,omitempty"`
+}
+
+// Rule is a single nftables rule, decoded into a sequence of Expression
+// values (a tagged union, see MatchMeta, MatchPayload, NAT, Counter, …).
+type Rule struct {
+	Handle      uint64       `json:"handle,omitempty"`
+	Expressions []Expression `json:"expressions"`
+}
+
+// Expression is one element of a Rule: a match, a verdict, a NAT action, a
+// counter reference, … Concrete types are MatchMeta, MatchPayload, NAT,
+// Counter, TCPOptionClampMSS, MatchSet, Verdict and Unknown.
+type Expression interface {
+	expressionType() string
+}
+
+// MatchMeta matches packet metadata, e.g. the incoming or outgoing
+// interface name.
+type MatchMeta struct {
+	Key   string `json:"key"` // e.g. "iifname", "oifname"
+	Value string `json:"value"`
+}
+
+func (MatchMeta) expressionType() string { return "meta" }
+
+// MatchPayload matches a field within the packet payload, e.g. the
+// destination port of a TCP or UDP header.
+type MatchPayload struct {
+	Proto string `json:"proto"` // e.g. "tcp", "udp"
+	Field string `json:"field"` // e.g. "dport", "flags"
+	Value string `json:"value"`
+}
+
+func (MatchPayload) expressionType() string { return "payload" }
+
+// NATType identifies the kind of network address translation a NAT
+// expression performs.
+type NATType string
+
+// Possible NATType values.
+const (
+	NATTypeDNAT       NATType = "dnat"
+	NATTypeMasquerade NATType = "masquerade"
+)
+
+// NAT is a network address/port translation action.
+type NAT struct {
+	Type NATType `json:"type"`
+	Addr string  `json:"addr,omitempty"`
+	Port string  `json:"port,omitempty"`
+}
+
+func (NAT) expressionType() string { return "nat" }
+
+// Counter references a named stateful counter object.
+type Counter struct {
+	Name string `json:"name"`
+}
+
+func (Counter) expressionType() string { return "counter" }
+
+// TCPOptionClampMSS represents `tcp option maxseg size set rt mtu`, used to
+// clamp the TCP MSS to the path MTU on the forward chain.
+type TCPOptionClampMSS struct{}
+
+func (TCPOptionClampMSS) expressionType() string { return "tcpclampmss" }
+
+// MatchSet matches the source address previously loaded into a register
+// against a named nftables set, e.g. `ip saddr @geo_de_v4`, used to
+// GeoIP-scope a port forwarding to (or exclude it from) a set of countries.
+type MatchSet struct {
+	Name   string `json:"name"`
+	Invert bool   `json:"invert,omitempty"`
+}
+
+func (MatchSet) expressionType() string { return "set" }
+
+// VerdictType identifies the action a Verdict expression performs.
+type VerdictType string
+
+// Possible VerdictType values. router7 only ever installs "drop" itself,
+// but a foreign rule decoded by DumpRuleset may carry any nftables verdict.
+const (
+	VerdictTypeDrop     VerdictType = "drop"
+	VerdictTypeAccept   VerdictType = "accept"
+	VerdictTypeContinue VerdictType = "continue"
+	VerdictTypeReturn   VerdictType = "return"
+)
+
+// Verdict ends rule evaluation, e.g. `drop` on a GeoIP-blocked forward-chain
+// rule (see BlockCountries).
+type Verdict struct {
+	Type VerdictType `json:"type"`
+}
+
+func (Verdict) expressionType() string { return "verdict" }
+
+// Unknown is a decoded placeholder for an expr.Any this package does not
+// otherwise model (e.g. a hand-added `nft` rule using a match router7 itself
+// never generates). Raw holds a best-effort %#v rendering of each
+// unrecognized expression, for diagnostics only; it is never re-encoded.
+type Unknown struct {
+	Raw []string `json:"raw"`
+}
+
+func (Unknown) expressionType() string { return "unknown" }
+
+type exprEnvelope struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// MarshalJSON implements json.Marshaler, tagging each Expression with its
+// expressionType() so UnmarshalJSON can reconstruct the concrete type.
+func (r Rule) MarshalJSON() ([]byte, error) {
+	type alias struct {
+		Handle      uint64         `json:"handle,omitempty"`
+		Expressions []exprEnvelope `json:"expressions"`
+	}
+	a := alias{Handle: r.Handle}
+	for _, e := range r.Expressions {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		a.Expressions = append(a.Expressions, exprEnvelope{Type: e.expressionType(), Data: data})
+	}
+	return json.Marshal(a)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, the inverse of MarshalJSON.
+func (r *Rule) UnmarshalJSON(b []byte) error {
+	var a struct {
+		Handle      uint64         `json:"handle,omitempty"`
+		Expressions []exprEnvelope `json:"expressions"`
+	}
+	if err := json.Unmarshal(b, &a); err != nil {
+		return err
+	}
+	r.Handle = a.Handle
+	r.Expressions = nil
+	for _, env := range a.Expressions {
+		e, err := unmarshalExpression(env)
+		if err != nil {
+			return err
+		}
+		r.Expressions = append(r.Expressions, e)
+	}
+	return nil
+}
+
+func unmarshalExpression(env exprEnvelope) (Expression, error) {
+	switch env.Type {
+	case "meta":
+		var e MatchMeta
+		return e, json.Unmarshal(env.Data, &e)
+	case "payload":
+		var e MatchPayload
+		return e, json.Unmarshal(env.Data, &e)
+	case "nat":
+		var e NAT
+		return e, json.Unmarshal(env.Data, &e)
+	case "counter":
+		var e Counter
+		return e, json.Unmarshal(env.Data, &e)
+	case "tcpclampmss":
+		var e TCPOptionClampMSS
+		return e, json.Unmarshal(env.Data, &e)
+	case "set":
+		var e MatchSet
+		return e, json.Unmarshal(env.Data, &e)
+	case "verdict":
+		var e Verdict
+		return e, json.Unmarshal(env.Data, &e)
+	case "unknown":
+		var e Unknown
+		return e, json.Unmarshal(env.Data, &e)
+	default:
+		return nil, fmt.Errorf("unknown expression type %q", env.Type)
+	}
+}
+
+// decodeExprs reconstructs a Rule's Expressions directly from the kernel's
+// own expr.Any sequence (as returned by Conn.GetRules), the mirror image of
+// toNFTExprs. Each decodeXXX helper recognizes the handful of expr.Any
+// patterns toNFTExprs itself emits and reports how many elements it
+// consumed; a prefix this package does not recognize (e.g. a rule crafted
+// by nft(8) or a different program) becomes a single Unknown per
+// unrecognized expression, rather than aborting the whole rule.
+func decodeExprs(raw []expr.Any) []Expression {
+	var out []Expression
+	for i := 0; i < len(raw); {
+		for _, decode := range []func([]expr.Any) (Expression, int){
+			decodeMetaMatch,
+			decodePayloadMatch,
+			decodeNAT,
+			decodeMatchSet,
+			decodeClampMSS,
+			decodeCounter,
+			decodeVerdict,
+		} {
+			if e, n := decode(raw[i:]); n > 0 {
+				out = append(out, e)
+				i += n
+				goto next
+			}
+		}
+		out = append(out, Unknown{Raw: []string{fmt.Sprintf("%#v", raw[i])}})
+		i++
+	next:
+	}
+	return out
+}
+
+// decodeMetaMatch recognizes the expr.Meta/expr.Cmp pair an
+// iifname/oifname MatchMeta lowers to.
+func decodeMetaMatch(raw []expr.Any) (Expression, int) {
+	if len(raw) < 2 {
+		return nil, 0
+	}
+	m, ok := raw[0].(*expr.Meta)
+	if !ok || m.Register != 1 {
+		return nil, 0
+	}
+	c, ok := raw[1].(*expr.Cmp)
+	if !ok || c.Register != 1 || c.Op != expr.CmpOpEq {
+		return nil, 0
+	}
+	key := "iifname"
+	if m.Key == expr.MetaKeyOIFNAME {
+		key = "oifname"
+	}
+	return MatchMeta{Key: key, Value: binaryutil.String(c.Data)}, 2
+}
+
+// decodePayloadMatch recognizes the three payload-match shapes
+// payloadExprs produces: a TCP flags test, a destination port range and a
+// single destination port. Proto (and, for a named port, the service name
+// rather than its numeric value) cannot be recovered from the wire
+// representation alone; DumpRuleset backfills them from UserData when
+// available (see enrichPayloadMatch).
+func decodePayloadMatch(raw []expr.Any) (Expression, int) {
+	p, ok := raw[0].(*expr.Payload)
+	if !ok || p.Base != expr.PayloadBaseTransportHeader || p.DestRegister != 1 {
+		return nil, 0
+	}
+	if p.Offset == 13 && p.Len == 1 {
+		if len(raw) < 3 {
+			return nil, 0
+		}
+		if _, ok := raw[1].(*expr.Bitwise); !ok {
+			return nil, 0
+		}
+		if _, ok := raw[2].(*expr.Cmp); !ok {
+			return nil, 0
+		}
+		return MatchPayload{Proto: "tcp", Field: "flags", Value: "syn"}, 3
+	}
+	if p.Offset != 2 || p.Len != 2 {
+		return nil, 0
+	}
+	if len(raw) >= 3 {
+		if lo, ok := raw[1].(*expr.Cmp); ok && lo.Op == expr.CmpOpGte {
+			if hi, ok := raw[2].(*expr.Cmp); ok && hi.Op == expr.CmpOpLte {
+				value := fmt.Sprintf("%d-%d", binaryutil.BigEndian.Uint16(lo.Data), binaryutil.BigEndian.Uint16(hi.Data))
+				return MatchPayload{Field: "dport", Value: value}, 3
+			}
+		}
+	}
+	if len(raw) >= 2 {
+		if c, ok := raw[1].(*expr.Cmp); ok && c.Op == expr.CmpOpEq {
+			port := binaryutil.BigEndian.Uint16(c.Data)
+			return MatchPayload{Field: "dport", Value: strconv.Itoa(int(port))}, 2
+		}
+	}
+	return nil, 0
+}
+
+// decodeNAT recognizes both natExprs shapes: a bare expr.Masq, or an
+// address (and optional port/port-range) loaded into registers followed by
+// an expr.NAT performing the DNAT.
+func decodeNAT(raw []expr.Any) (Expression, int) {
+	if _, ok := raw[0].(*expr.Masq); ok {
+		return NAT{Type: NATTypeMasquerade}, 1
+	}
+
+	addrImm, ok := raw[0].(*expr.Immediate)
+	if !ok || addrImm.Register != 1 {
+		return nil, 0
+	}
+	addr := net.IP(addrImm.Data).String()
+
+	i, port := 1, ""
+	if i < len(raw) {
+		if lo, ok := raw[i].(*expr.Immediate); ok && lo.Register == 2 {
+			i++
+			loPort := binaryutil.BigEndian.Uint16(lo.Data)
+			if i < len(raw) {
+				if hi, ok := raw[i].(*expr.Immediate); ok && hi.Register == 3 {
+					port = fmt.Sprintf("%d-%d", loPort, binaryutil.BigEndian.Uint16(hi.Data))
+					i++
+				}
+			}
+			if port == "" {
+				port = strconv.Itoa(int(loPort))
+			}
+		}
+	}
+
+	if i >= len(raw) {
+		return nil, 0
+	}
+	n, ok := raw[i].(*expr.NAT)
+	if !ok || n.Type != expr.NATTypeDestNAT {
+		return nil, 0
+	}
+	return NAT{Type: NATTypeDNAT, Addr: addr, Port: port}, i + 1
+}
+
+// decodeMatchSet recognizes the source-address-load/Lookup pair a MatchSet
+// lowers to, for either the IPv4 (offset 12, 4 bytes) or IPv6 (offset 8, 16
+// bytes) source address.
+func decodeMatchSet(raw []expr.Any) (Expression, int) {
+	if len(raw) < 2 {
+		return nil, 0
+	}
+	p, ok := raw[0].(*expr.Payload)
+	if !ok || p.Base != expr.PayloadBaseNetworkHeader {
+		return nil, 0
+	}
+	isIPv4Src := p.Offset == 12 && p.Len == 4
+	isIPv6Src := p.Offset == 8 && p.Len == 16
+	if !isIPv4Src && !isIPv6Src {
+		return nil, 0
+	}
+	l, ok := raw[1].(*expr.Lookup)
+	if !ok {
+		return nil, 0
+	}
+	return MatchSet{Name: l.SetName, Invert: l.Invert}, 2
+}
+
+// decodeClampMSS recognizes the exthdr/rt/exthdr triple a
+// TCPOptionClampMSS lowers to. The kernel does not echo the middle
+// expr.Rt back in GetRules's response (observed against a live kernel),
+// so a bare exthdr/exthdr pair is accepted too.
+func decodeClampMSS(raw []expr.Any) (Expression, int) {
+	first, ok := raw[0].(*expr.Exthdr)
+	if !ok || first.Op != expr.ExthdrOpTcpopt {
+		return nil, 0
+	}
+	if len(raw) >= 3 {
+		if _, ok := raw[1].(*expr.Rt); ok {
+			if _, ok := raw[2].(*expr.Exthdr); ok {
+				return TCPOptionClampMSS{}, 3
+			}
+		}
+	}
+	if len(raw) >= 2 {
+		if _, ok := raw[1].(*expr.Exthdr); ok {
+			return TCPOptionClampMSS{}, 2
+		}
+	}
+	return nil, 0
+}
+
+// decodeCounter recognizes a bare expr.Counter. Which named CounterObj (if
+// any) the rule refers to is not part of the wire representation — router7
+// tracks that association itself (see forwardCounterName) — so Name is left
+// empty here; DumpRuleset backfills it from UserData for rules this package
+// created.
+func decodeCounter(raw []expr.Any) (Expression, int) {
+	if _, ok := raw[0].(*expr.Counter); ok {
+		return Counter{}, 1
+	}
+	return nil, 0
+}
+
+// decodeVerdict recognizes an expr.Verdict, e.g. the `drop` terminating a
+// GeoIP-blocked forward-chain rule (see BlockCountries).
+func decodeVerdict(raw []expr.Any) (Expression, int) {
+	v, ok := raw[0].(*expr.Verdict)
+	if !ok {
+		return nil, 0
+	}
+	switch v.Kind {
+	case expr.VerdictDrop:
+		return Verdict{Type: VerdictTypeDrop}, 1
+	case expr.VerdictAccept:
+		return Verdict{Type: VerdictTypeAccept}, 1
+	case expr.VerdictContinue:
+		return Verdict{Type: VerdictTypeContinue}, 1
+	case expr.VerdictReturn:
+		return Verdict{Type: VerdictTypeReturn}, 1
+	default:
+		return Unknown{Raw: []string{fmt.Sprintf("%#v", v)}}, 1
+	}
+}
+
+// enrichFromUserData backfills the fields decodeExprs cannot recover from
+// the wire representation alone (a MatchPayload's protocol and, for a named
+// port, its service name rather than numeric value; a Counter's object
+// name) from the rule's UserData, for rules this package itself created.
+// It is a no-op (and harmless) for foreign rules: userData is nil, or its
+// decoded Expressions don't line up 1:1 with wire, in which case enrichment
+// is simply skipped for that rule.
+func enrichFromUserData(wire []Expression, userData []byte) []Expression {
+	if len(userData) == 0 {
+		return wire
+	}
+	var stashed Rule
+	if err := json.Unmarshal(userData, &stashed); err != nil || len(stashed.Expressions) != len(wire) {
+		return wire
+	}
+	for i, e := range wire {
+		switch w := e.(type) {
+		case MatchPayload:
+			if s, ok := stashed.Expressions[i].(MatchPayload); ok && w.Field == s.Field {
+				w.Proto = s.Proto
+				w.Value = s.Value
+				wire[i] = w
+			}
+		case Counter:
+			if s, ok := stashed.Expressions[i].(Counter); ok {
+				w.Name = s.Name
+				wire[i] = w
+			}
+		}
+	}
+	return wire
+}
+
+// DumpRuleset decodes the nftables ruleset currently installed in the
+// calling network namespace, speaking NFNETLINK directly to the kernel
+// (via github.com/google/nftables) rather than exec'ing nft(8) and parsing
+// its text output. Each rule's Expressions are decoded from the kernel's
+// own returned expr.Any sequence (see decodeExprs), so rules this package
+// did not itself create (added by nft(8), by a different process, or
+// missing UserData for any reason) still come back with populated
+// Expressions — a handful of fields that have no wire representation (a
+// MatchPayload's protocol, a Counter's object name) are additionally
+// enriched from UserData where available, but their absence does not
+// prevent the rest of a rule from decoding.
+func DumpRuleset() (*Ruleset, error) {
+	conn := &nftables.Conn{}
+	tables, err := conn.ListTables()
+	if err != nil {
+		return nil, fmt.Errorf("listing tables: %v", err)
+	}
+
+	var result Ruleset
+	for _, t := range tables {
+		table := Table{Name: t.Name, Family: familyOf(t.Family)}
+
+		sets, err := conn.GetSets(t)
+		if err != nil {
+			return nil, fmt.Errorf("listing sets of table %s: %v", t.Name, err)
+		}
+		for _, s := range sets {
+			set := Set{Name: s.Name}
+			elements, err := conn.GetSetElements(s)
+			if err != nil {
+				return nil, fmt.Errorf("listing elements of set %s: %v", s.Name, err)
+			}
+			set.Elements = decodeIntervalElements(elements)
+			sort.Strings(set.Elements)
+			table.Sets = append(table.Sets, set)
+		}
+
+		chains, err := conn.ListChainsOfTableFamily(t.Family)
+		if err != nil {
+			return nil, fmt.Errorf("listing chains of table %s: %v", t.Name, err)
+		}
+		for _, c := range chains {
+			if c.Table.Name != t.Name {
+				continue
+			}
+			chain := Chain{Name: c.Name}
+			if c.Hooknum != nil {
+				chain.Hook = hookName(*c.Hooknum)
+			}
+			if c.Priority != nil {
+				chain.Priority = int(*c.Priority)
+			}
+			if c.Policy != nil {
+				chain.Policy = policyName(*c.Policy)
+			}
+
+			rules, err := conn.GetRules(t, c)
+			if err != nil {
+				return nil, fmt.Errorf("listing rules of chain %s: %v", c.Name, err)
+			}
+			for _, r := range rules {
+				rule := Rule{
+					Handle:      r.Handle,
+					Expressions: enrichFromUserData(decodeExprs(r.Exprs), r.UserData),
+				}
+				chain.Rules = append(chain.Rules, rule)
+				for _, e := range rule.Expressions {
+					if counter, ok := e.(Counter); ok {
+						chain.Counters = append(chain.Counters, counterState(conn, t, counter.Name))
+					}
+				}
+			}
+
+			table.Chains = append(table.Chains, chain)
+		}
+
+		result.Tables = append(result.Tables, table)
+	}
+	return &result, nil
+}
+
+func counterState(conn *nftables.Conn, t *nftables.Table, name string) CounterObj {
+	obj, err := conn.GetObj(&nftables.CounterObj{Table: t, Name: name})
+	if err != nil || len(obj) == 0 {
+		return CounterObj{Name: name}
+	}
+	c, ok := obj[0].(*nftables.CounterObj)
+	if !ok {
+		return CounterObj{Name: name}
+	}
+	return CounterObj{Name: name, Packets: c.Packets, Bytes: c.Bytes}
+}
+
+func familyOf(f nftables.TableFamily) Family {
+	if f == nftables.TableFamilyIPv6 {
+		return FamilyIP6
+	}
+	return FamilyIP
+}
+
+func hookName(h nftables.ChainHook) string {
+	switch h {
+	case *nftables.ChainHookPrerouting:
+		return "prerouting"
+	case *nftables.ChainHookPostrouting:
+		return "postrouting"
+	case *nftables.ChainHookForward:
+		return "forward"
+	case *nftables.ChainHookInput:
+		return "input"
+	case *nftables.ChainHookOutput:
+		return "output"
+	default:
+		return ""
+	}
+}
+
+func policyName(p nftables.ChainPolicy) string {
+	if p == nftables.ChainPolicyDrop {
+		return "drop"
+	}
+	return "accept"
+}
+
+// DiagnoseHandler returns an http.Handler that serves the current ruleset as
+// JSON, so that operators can inspect live rule state without depending on
+// the nft binary.
+func DiagnoseHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ruleset, err := DumpRuleset()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(ruleset); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}